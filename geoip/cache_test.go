@@ -0,0 +1,45 @@
+package geoip
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestCachePrefixKey(t *testing.T) {
+	tests := []struct {
+		name string
+		ip   string
+		want string
+	}{
+		{name: "IPv4", ip: "192.0.2.2", want: "192.0.2.0/24"},
+		{name: "IPv4 other host, same /24", ip: "192.0.2.200", want: "192.0.2.0/24"},
+		{name: "IPv6", ip: "2001:db8::1", want: "2001:db8::/48"},
+		{name: "4-in-6 matches its plain IPv4 key", ip: "::ffff:192.0.2.2", want: "192.0.2.0/24"},
+		{name: "4-in-6 other host, same /24", ip: "::ffff:192.0.2.200", want: "192.0.2.0/24"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip := netip.MustParseAddr(tt.ip)
+			if got := cachePrefixKey(ip); got != tt.want {
+				t.Errorf("cachePrefixKey(%s) = %q, want %q", tt.ip, got, tt.want)
+			}
+		})
+	}
+
+	// A 4-in-6 address must not collapse into the same key as an unrelated
+	// native IPv6 address that happens to start with zero bytes.
+	mapped := cachePrefixKey(netip.MustParseAddr("::ffff:192.0.2.2"))
+	native := cachePrefixKey(netip.MustParseAddr("::1"))
+	if mapped == native {
+		t.Errorf("4-in-6 address collapsed into the same key as an unrelated native IPv6 address: %q", mapped)
+	}
+}
+
+func TestCachePrefixKeyDistinguishesDifferentPrefixes(t *testing.T) {
+	a := cachePrefixKey(netip.MustParseAddr("::ffff:192.0.2.2"))
+	b := cachePrefixKey(netip.MustParseAddr("::ffff:203.0.113.5"))
+	if a == b {
+		t.Errorf("distinct /24s collapsed into the same cache key: %q", a)
+	}
+}
@@ -2,6 +2,9 @@ package geoip
 
 import (
 	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
@@ -10,43 +13,187 @@ import (
 	"time"
 )
 
-// downloadGeoDB fetches geo ip database and saves it on given filepath
-func downloadGeoDB(uri string, filepath string) error {
-	client := &http.Client{
-		Timeout: 30 * time.Second,
+// downloadMeta records the validators from the last successful download of
+// a geo ip database, persisted alongside it so the next sync can send a
+// conditional request.
+type downloadMeta struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+func readDownloadMeta(path string) downloadMeta {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return downloadMeta{}
 	}
 
-	resp, err := client.Get(uri)
+	var meta downloadMeta
+	_ = json.Unmarshal(data, &meta)
+	return meta
+}
+
+func writeDownloadMeta(path string, meta downloadMeta) error {
+	data, err := json.Marshal(meta)
 	if err != nil {
 		return err
 	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+// downloadGeoDB fetches the geo ip database from uri and atomically installs
+// it at filepath: it downloads to "<filepath>.tmp", optionally verifies a
+// SHA256 checksum, then os.Renames the temp file into place so a crash
+// mid-download never corrupts an already-installed database.
+//
+// It sends If-None-Match/If-Modified-Since based on the previous download
+// (tracked in a "<filepath>.meta" sidecar) and reports downloaded=false
+// without touching filepath when the server answers 304. Transient HTTP
+// failures (network errors and 5xx responses) are retried with exponential
+// backoff.
+//
+// sha256Hex, when set, is the expected checksum of the decompressed
+// database. When empty, downloadGeoDB looks for a companion
+// "<uri>.sha256" file and verifies against that instead; if neither is
+// available the download proceeds unverified.
+func downloadGeoDB(uri string, filepath string, sha256Hex string) (downloaded bool, err error) {
+	metaPath := filepath + ".meta"
+	prevMeta := readDownloadMeta(metaPath)
+
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	resp, err := doWithRetry(client, uri, prevMeta)
+	if err != nil {
+		return false, err
+	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotModified {
+		return false, nil
+	}
+
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("bad status: %s", resp.Status)
+		return false, fmt.Errorf("bad status: %s", resp.Status)
 	}
 
-	var reader io.ReadCloser
+	var reader io.ReadCloser = resp.Body
 	if strings.Contains(resp.Header.Get("Content-Encoding"), "gzip") {
-		reader, err = gzip.NewReader(resp.Body)
+		gzReader, err := gzip.NewReader(resp.Body)
 		if err != nil {
-			return err
+			return false, err
 		}
-		defer reader.Close()
-	} else {
-		reader = resp.Body
+		defer gzReader.Close()
+		reader = gzReader
 	}
 
-	out, err := os.Create(filepath)
+	if sha256Hex == "" {
+		if fetched, err := fetchCompanionSHA256(client, uri); err == nil {
+			sha256Hex = fetched
+		}
+	}
+
+	tmpPath := filepath + ".tmp"
+	out, err := os.Create(tmpPath)
 	if err != nil {
-		return fmt.Errorf("failed to create or truncate file: %w", err)
+		return false, fmt.Errorf("failed to create temp file: %w", err)
+	}
+
+	hasher := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(out, hasher), reader); err != nil {
+		out.Close()
+		os.Remove(tmpPath)
+		return false, fmt.Errorf("failed to write to temp file: %w", err)
 	}
-	defer out.Close()
 
-	_, err = io.Copy(out, reader)
+	if err := out.Close(); err != nil {
+		os.Remove(tmpPath)
+		return false, fmt.Errorf("failed to close temp file: %w", err)
+	}
+
+	if sha256Hex != "" {
+		if sum := hex.EncodeToString(hasher.Sum(nil)); !strings.EqualFold(sum, sha256Hex) {
+			os.Remove(tmpPath)
+			return false, fmt.Errorf("checksum mismatch: got %s, want %s", sum, sha256Hex)
+		}
+	}
+
+	if err := os.Rename(tmpPath, filepath); err != nil {
+		os.Remove(tmpPath)
+		return false, fmt.Errorf("failed to install downloaded db: %w", err)
+	}
+
+	_ = writeDownloadMeta(metaPath, downloadMeta{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	})
+
+	return true, nil
+}
+
+// doWithRetry issues the conditional GET for uri, retrying transient
+// failures (network errors and 5xx responses) with exponential backoff, for
+// at most 4 attempts in all. The caller is responsible for closing the returned
+// response body.
+func doWithRetry(client *http.Client, uri string, prevMeta downloadMeta) (*http.Response, error) {
+	const maxAttempts = 4
+	backoff := 500 * time.Millisecond
+
+	var lastErr error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		req, err := http.NewRequest(http.MethodGet, uri, nil)
+		if err != nil {
+			return nil, err
+		}
+		if prevMeta.ETag != "" {
+			req.Header.Set("If-None-Match", prevMeta.ETag)
+		}
+		if prevMeta.LastModified != "" {
+			req.Header.Set("If-Modified-Since", prevMeta.LastModified)
+		}
+
+		resp, err := client.Do(req)
+		if err == nil && resp.StatusCode < 500 {
+			return resp, nil
+		}
+
+		if err != nil {
+			lastErr = err
+		} else {
+			lastErr = fmt.Errorf("bad status: %s", resp.Status)
+			resp.Body.Close()
+		}
+
+		if attempt == maxAttempts {
+			break
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+
+	return nil, fmt.Errorf("failed to download geoip db after %d attempts: %w", maxAttempts, lastErr)
+}
+
+// fetchCompanionSHA256 fetches "<uri>.sha256" and returns the trimmed hex
+// digest it contains.
+func fetchCompanionSHA256(client *http.Client, uri string) (string, error) {
+	resp, err := client.Get(uri + ".sha256")
 	if err != nil {
-		return fmt.Errorf("failed to write to file: %w", err)
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("bad status: %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	fields := strings.Fields(string(body))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("empty checksum file")
 	}
 
-	return nil
+	return fields[0], nil
 }
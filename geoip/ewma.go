@@ -0,0 +1,39 @@
+package geoip
+
+import "sync"
+
+// ewma is a simple exponentially weighted moving average used to smooth RTT
+// samples collected from repeated health checks.
+type ewma struct {
+	mu    sync.Mutex
+	value float64
+	alpha float64
+	set   bool
+}
+
+func newEwma(alpha float64) *ewma {
+	if alpha <= 0 || alpha > 1 {
+		alpha = 0.3
+	}
+	return &ewma{alpha: alpha}
+}
+
+func (e *ewma) update(sample float64) float64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.set {
+		e.value = sample
+		e.set = true
+	} else {
+		e.value = e.alpha*sample + (1-e.alpha)*e.value
+	}
+
+	return e.value
+}
+
+func (e *ewma) get() float64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.value
+}
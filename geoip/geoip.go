@@ -4,17 +4,16 @@ import (
 	"context"
 	"fmt"
 	"math"
-	"net"
-	"net/http"
 	"net/netip"
-	"net/url"
 	"os"
 	"sync"
-	"sync/atomic"
 	"time"
 
+	"github.com/hashicorp/golang-lru/v2/expirable"
 	"github.com/oschwald/maxminddb-golang/v2"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
 )
 
 type GeoLocation struct {
@@ -22,14 +21,11 @@ type GeoLocation struct {
 	Long float64
 }
 
-type GeoCacheEntry struct {
-	Domain     string
-	TTLSec     int
-	InsertTime time.Time
-}
-
 type DomainGeoLocation struct {
 	GeoLocation
+	Country ISOCountry
+	ASN     ASN
+	Weight  float64
 	IsAlive bool
 }
 
@@ -45,14 +41,24 @@ type GeoIpDatabase struct {
 	database               *maxminddb.Reader
 	databaseUri            string
 	databaseLock           sync.RWMutex
+	mmdbSha256             string
 	periodicDbDownloadDays int
-	cache                  sync.Map
-	CacheLen               *atomic.Uint64
-	maxCacheSize           int
+	providers              *ProviderChain
+	cache                  *expirable.LRU[string, string]
+	cacheGroup             singleflight.Group
+	cacheHits              prometheus.Counter
+	cacheMisses            prometheus.Counter
+	cacheEvictions         prometheus.Counter
+	cachePrefixSize        prometheus.Histogram
 	domainLocations        map[string]*DomainGeoLocation
 	domainLocationsLock    sync.RWMutex
+	domainRTT              sync.Map
+	domainWeights          map[string]float64
 	hostingDomains         []string
-	healthUri              string
+	healthChecker          *HealthChecker
+	rules                  *RuleSet
+	selectionStrategy      SelectionStrategy
+	scorer                 Scorer
 	logger                 *zap.Logger
 }
 
@@ -60,29 +66,139 @@ type NewGeoIpDatabaseArgs struct {
 	Logger                   *zap.Logger
 	MmdbPathUri              string
 	MmdbPath                 string
+	// MmdbSha256, when set, is the expected SHA256 checksum of the
+	// downloaded mmdb file; an empty value falls back to a companion
+	// "<MmdbPathUri>.sha256" file, if one exists.
+	MmdbSha256               string
 	MmdbPeriodicDownloadDays int
 	MaxCacheSize             int
+	CacheTTLSeconds          int
 	HostingDomains           []string
-	HealthUri                string
+	// HealthCheck configures the active health checker used to probe
+	// HostingDomains, and the passive circuit breaker fed from ServeHTTP.
+	HealthCheck HealthCheckConfig
+	// MetricsRegistry, when set, is used to register the cache hit/miss/
+	// eviction counters and the prefix-size histogram.
+	MetricsRegistry *prometheus.Registry
+	// Providers, when non-empty, replaces the built-in MaxMind mmdb lookup
+	// with a stacked chain of geo providers tried in order until one succeeds.
+	Providers []ProviderConfig
+	// SelectionStrategy picks the Scorer PickBestDomain uses; defaults to
+	// SelectionStrategyGeo.
+	SelectionStrategy SelectionStrategy
+	// MixCoefficient is only used by SelectionStrategyHybrid, and controls the
+	// blend between geo distance (0) and measured RTT (1).
+	MixCoefficient float64
+	// DomainWeights assigns a relative capacity weight to each hosting
+	// domain, used by SelectionStrategyWeighted. Domains not present default
+	// to a weight of 1.
+	DomainWeights map[string]float64
+	// Rules are geofencing overrides evaluated, in order, before the
+	// haversine picker; the first matching rule decides the response.
+	Rules []Rule
+}
+
+// legacyMaxMindProvider adapts GeoIpDatabase's built-in mmdb download/sync
+// machinery to the GeoProvider interface, so it keeps working as the default
+// provider when no explicit Providers are configured.
+type legacyMaxMindProvider struct {
+	db *GeoIpDatabase
+}
+
+func (p *legacyMaxMindProvider) Lookup(ip netip.Addr) (GeoLocation, ISOCountry, ASN, error) {
+	p.db.databaseLock.RLock()
+	defer p.db.databaseLock.RUnlock()
+
+	var record MMDBLocation
+	if err := p.db.database.Lookup(ip).Decode(&record); err != nil {
+		return GeoLocation{}, "", 0, fmt.Errorf("failed ip lookup: %w", err)
+	}
+
+	return GeoLocation{Lat: record.Location.Latitude, Long: record.Location.Longitude}, "", 0, nil
+}
+
+func (p *legacyMaxMindProvider) Close() error {
+	return nil
 }
 
 // GeoIpDatabase loads mmdb in memory so we can reuse it
 // if mmdbPath is empty string we will by default use in memory DB-IP and download it every month
 func NewGeoIpDatabase(args *NewGeoIpDatabaseArgs) (*GeoIpDatabase, error) {
+	if args.CacheTTLSeconds < 10 {
+		return nil, fmt.Errorf("cache ttl can't be lower then 10 seconds: %d", args.CacheTTLSeconds)
+	}
+
+	cacheHits := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "caddy_geo_redirect_cache_hits_total",
+		Help: "Number of domain selection cache hits.",
+	})
+	cacheMisses := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "caddy_geo_redirect_cache_misses_total",
+		Help: "Number of domain selection cache misses.",
+	})
+	cacheEvictions := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "caddy_geo_redirect_cache_evictions_total",
+		Help: "Number of domain selection cache entries evicted (LRU or TTL).",
+	})
+	cachePrefixSize := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "caddy_geo_redirect_cache_prefix_bits",
+		Help:    "Distribution of cache key prefix sizes in bits (24 for IPv4, 48 for IPv6).",
+		Buckets: []float64{24, 48},
+	})
+	if args.MetricsRegistry != nil {
+		args.MetricsRegistry.MustRegister(cacheHits, cacheMisses, cacheEvictions, cachePrefixSize)
+	}
+
+	healthChecker, err := NewHealthChecker(args.HealthCheck, args.MetricsRegistry)
+	if err != nil {
+		return nil, err
+	}
+
+	rules, err := NewRuleSet(args.Rules)
+	if err != nil {
+		return nil, err
+	}
+
 	geoIpDb := &GeoIpDatabase{
 		databasePath:           args.MmdbPath,
 		databaseUri:            args.MmdbPathUri,
+		mmdbSha256:             args.MmdbSha256,
 		periodicDbDownloadDays: args.MmdbPeriodicDownloadDays,
-		maxCacheSize:           args.MaxCacheSize,
 		hostingDomains:         args.HostingDomains,
 		domainLocations:        make(map[string]*DomainGeoLocation),
-		CacheLen:               &atomic.Uint64{},
-		healthUri:              args.HealthUri,
+		domainWeights:          args.DomainWeights,
+		healthChecker:          healthChecker,
+		rules:                  rules,
+		selectionStrategy:      args.SelectionStrategy,
+		scorer:                 scorerForStrategy(args.SelectionStrategy, args.MixCoefficient),
 		logger:                 args.Logger,
+		cacheHits:              cacheHits,
+		cacheMisses:            cacheMisses,
+		cacheEvictions:         cacheEvictions,
+		cachePrefixSize:        cachePrefixSize,
 	}
 
-	if err := geoIpDb.syncDatabase(); err != nil {
-		return nil, err
+	geoIpDb.cache = expirable.NewLRU[string, string](
+		args.MaxCacheSize,
+		func(string, string) { geoIpDb.cacheEvictions.Inc() },
+		time.Duration(args.CacheTTLSeconds)*time.Second,
+	)
+
+	if len(args.Providers) > 0 {
+		providers := make([]GeoProvider, 0, len(args.Providers))
+		for _, cfg := range args.Providers {
+			provider, err := newProvider(cfg)
+			if err != nil {
+				return nil, err
+			}
+			providers = append(providers, provider)
+		}
+		geoIpDb.providers = NewProviderChain(providers...)
+	} else {
+		if err := geoIpDb.syncDatabase(); err != nil {
+			return nil, err
+		}
+		geoIpDb.providers = NewProviderChain(&legacyMaxMindProvider{db: geoIpDb})
 	}
 
 	geoIpDb.updateDomainLocations()
@@ -111,20 +227,39 @@ func (g *GeoIpDatabase) syncDatabase() error {
 	}
 
 	if shouldDownload {
-		if err := downloadGeoDB(g.databaseUri, g.databasePath); err != nil {
+		downloaded, err := downloadGeoDB(g.databaseUri, g.databasePath, g.mmdbSha256)
+		if err != nil {
 			return err
 		}
+		if !downloaded {
+			// Server reported the database hasn't changed (304): touch the
+			// file so we don't send another conditional request until the
+			// next period.
+			now := time.Now()
+			_ = os.Chtimes(g.databasePath, now, now)
+		}
 	}
 
-	db, err := maxminddb.Open(g.databasePath)
+	newDb, err := maxminddb.Open(g.databasePath)
 	if err != nil {
 		return fmt.Errorf("failed to load geoip db: %w", err)
 	}
 
 	g.databaseLock.Lock()
-	g.database = db
+	oldDb := g.database
+	g.database = newDb
 	g.databaseLock.Unlock()
 
+	// databaseLock is held for the full duration of every lookup (see
+	// legacyMaxMindProvider.Lookup), so by the time the write lock above was
+	// acquired any in-flight lookups against oldDb had already finished; it
+	// is now safe to close it.
+	if oldDb != nil {
+		if err := oldDb.Close(); err != nil {
+			g.logger.Error("failed to close previous geoip db", zap.Error(err))
+		}
+	}
+
 	return nil
 }
 
@@ -139,12 +274,9 @@ func (g *GeoIpDatabase) StartPeriodicGeoDBSyncer() {
 	}()
 }
 
-// updateDomainHealthState makes a health check request to domain
+// updateDomainHealthState actively health-checks each hosting domain via
+// g.healthChecker, and feeds each probe's RTT sample into the domain's EWMA.
 func (g *GeoIpDatabase) updateDomainHealthState() {
-	client := &http.Client{
-		Timeout: 4 * time.Second,
-	}
-
 	newLocations := make(map[string]*DomainGeoLocation)
 	for _, domain := range g.hostingDomains {
 		g.domainLocationsLock.RLock()
@@ -155,31 +287,15 @@ func (g *GeoIpDatabase) updateDomainHealthState() {
 			continue
 		}
 
-		uri := &url.URL{
-			Scheme: "http",
-			Host:   domain,
-			Path:   g.healthUri,
-		}
-		resp, err := client.Get(uri.String())
-
+		alive, rtt, err := g.healthChecker.Probe(domain)
 		if err != nil {
-			location.IsAlive = false
-			newLocations[domain] = location
 			g.logger.Error("failed health check", zap.String("domain", domain), zap.Error(err))
-			continue
 		}
-
-		if resp == nil {
-			continue
-		}
-
-		if resp.StatusCode >= 200 && resp.StatusCode < 400 {
-			location.IsAlive = true
-		} else {
-			location.IsAlive = false
-			g.logger.Error("failed health check", zap.String("domain", domain), zap.Int("code", resp.StatusCode))
+		if rtt > 0 {
+			g.recordDomainRTT(domain, rtt)
 		}
 
+		location.IsAlive = alive
 		newLocations[domain] = location
 	}
 
@@ -188,6 +304,20 @@ func (g *GeoIpDatabase) updateDomainHealthState() {
 	g.domainLocationsLock.Unlock()
 }
 
+// RecordPassiveHealthSignal feeds the status code of a response actually
+// served for domain into the health checker's passive circuit breaker, so a
+// domain that starts failing real traffic is marked down without waiting for
+// the next active probe.
+func (g *GeoIpDatabase) RecordPassiveHealthSignal(domain string, statusCode int) {
+	alive := g.healthChecker.RecordPassiveResult(domain, statusCode)
+
+	g.domainLocationsLock.Lock()
+	defer g.domainLocationsLock.Unlock()
+	if location, ok := g.domainLocations[domain]; ok {
+		location.IsAlive = alive
+	}
+}
+
 // updateDomainLocations is updating the domain location cache.
 func (g *GeoIpDatabase) updateDomainLocations() {
 	newLocations := make(map[string]*DomainGeoLocation)
@@ -195,31 +325,13 @@ func (g *GeoIpDatabase) updateDomainLocations() {
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 
-		hostIps, err := net.DefaultResolver.LookupIP(ctx, "ip4", domain)
+		ips, err := lookupDomainIPs(ctx, domain)
 		if err != nil {
 			g.logger.Error("failed to resolve domain", zap.String("domain", domain))
 			continue
 		}
 
-		if len(hostIps) == 0 {
-			continue
-		}
-
-		ips := make([]netip.Addr, 0, len(hostIps))
-		for _, ip := range hostIps {
-			hostNetIp, ok := netip.AddrFromSlice(ip)
-			if !ok {
-				continue
-			}
-
-			ips = append(ips, hostNetIp)
-		}
-
-		if len(ips) == 0 {
-			continue
-		}
-
-		loc, err := g.getIPLatLong(&ips[0])
+		loc, country, asn, err := g.getIPGeoInfo(ips[0])
 		if err != nil {
 			g.logger.Error("failed to get location of ip", zap.String("ip", ips[0].String()))
 			continue
@@ -227,6 +339,9 @@ func (g *GeoIpDatabase) updateDomainLocations() {
 
 		newLoc := DomainGeoLocation{
 			IsAlive: true,
+			Country: country,
+			ASN:     asn,
+			Weight:  g.domainWeight(domain),
 		}
 		newLoc.GeoLocation.Lat = loc.Lat
 		newLoc.GeoLocation.Long = loc.Long
@@ -238,7 +353,47 @@ func (g *GeoIpDatabase) updateDomainLocations() {
 	g.domainLocationsLock.Unlock()
 }
 
-// StartDomainLocationUpdater starts background process to periodically refresh domain locations and health check them
+// domainWeight returns the configured capacity weight for domain, defaulting
+// to 1 when unset.
+func (g *GeoIpDatabase) domainWeight(domain string) float64 {
+	if weight, ok := g.domainWeights[domain]; ok && weight > 0 {
+		return weight
+	}
+	return 1
+}
+
+// recordDomainRTT feeds a fresh RTT sample into the domain's EWMA.
+//
+// This is one EWMA per domain, not per (client prefix, domain) pair: samples
+// come from updateDomainHealthState's active probes, which run from the
+// Caddy process itself, so the only RTT this package ever observes is
+// "this server to that domain" — there's no vantage point to measure
+// "this client to that domain" from without standing up probing agents near
+// clients. RTTScorer/HybridScorer therefore rank domains by one global
+// latency figure, which is a reasonable proxy when all clients are
+// reasonably close to the Caddy instance but won't reflect a distant
+// client's actual path the way a true per-client measurement would.
+func (g *GeoIpDatabase) recordDomainRTT(domain string, sample time.Duration) {
+	v, _ := g.domainRTT.LoadOrStore(domain, newEwma(0.3))
+	v.(*ewma).update(float64(sample.Milliseconds()))
+}
+
+// getDomainRTT returns the domain's current EWMA RTT in milliseconds, or 0 if
+// no sample has been collected yet. See recordDomainRTT for why this is a
+// single global sample per domain rather than one per client region.
+func (g *GeoIpDatabase) getDomainRTT(domain string) float64 {
+	v, ok := g.domainRTT.Load(domain)
+	if !ok {
+		return 0
+	}
+	return v.(*ewma).get()
+}
+
+// StartDomainLocationAndHeathCheckUpdater starts two background processes:
+// one that periodically re-resolves hosting domains to refresh their geo
+// location on updateInterval, and one that actively health-checks them on
+// the health checker's own, typically much shorter, HealthCheckConfig.IntervalSeconds
+// cadence — a fast rise/fall debounce is pointless if probes only run hourly.
 func (g *GeoIpDatabase) StartDomainLocationAndHeathCheckUpdater(updateInterval time.Duration) {
 	if updateInterval < 30*time.Second {
 		updateInterval = 30 * time.Second
@@ -248,64 +403,121 @@ func (g *GeoIpDatabase) StartDomainLocationAndHeathCheckUpdater(updateInterval t
 	go func() {
 		for range tickerLoc.C {
 			g.updateDomainLocations()
-			g.updateDomainHealthState()
 		}
 	}()
-}
 
-// StartCacheCleanup start the cleanup process for caches that clears cache every 10sec
-func (g *GeoIpDatabase) StartCacheCleanup() {
-	ticker := time.NewTicker(10 * time.Second)
+	tickerHealth := time.NewTicker(g.healthChecker.Interval())
 	go func() {
-		for range ticker.C {
-			g.cache.Range(func(key, value any) bool {
-				entry := value.(GeoCacheEntry)
-				if time.Since(entry.InsertTime).Seconds() > float64(entry.TTLSec) {
-					g.cache.Delete(key)
-					g.CacheLen.Add(^uint64(0))
-				}
-				return true
-			})
+		for range tickerHealth.C {
+			g.updateDomainHealthState()
 		}
 	}()
 }
 
-// getIPLatLong lookups up lat,long geo data from mmdb database
-func (g *GeoIpDatabase) getIPLatLong(ip *netip.Addr) (*GeoLocation, error) {
-	g.databaseLock.RLock()
-	defer g.databaseLock.RUnlock()
+// CacheLen returns the number of entries currently held in the domain
+// selection cache.
+func (g *GeoIpDatabase) CacheLen() int {
+	return g.cache.Len()
+}
 
-	var record MMDBLocation
-	if err := g.database.Lookup(*ip).Decode(&record); err != nil {
-		return nil, fmt.Errorf("failed ip lookup: %w", err)
+// cachePrefixBits returns 24 for IPv4 addresses and 48 for IPv6 addresses.
+// ip must already be unmapped (see cachePrefixKey), so a 4-in-6 address
+// isn't mistaken for native IPv6.
+func cachePrefixBits(ip netip.Addr) int {
+	if ip.Is6() {
+		return 48
+	}
+	return 24
+}
+
+// cachePrefixKey returns the cache key for ip: a /24 for IPv4 and a /48 for
+// IPv6, so nearby clients share one cache entry instead of exploding the
+// cache per individual address.
+func cachePrefixKey(ip netip.Addr) string {
+	// Unmap 4-in-6 addresses (e.g. ::ffff:a.b.c.d) first: Prefix() masks
+	// bits of the 16-byte in-memory form, and masking a 4-in-6 address as
+	// if it were native IPv6 zeroes out its leading ::ffff bytes instead of
+	// the embedded IPv4 address, collapsing every client into one key.
+	ip = ip.Unmap()
+
+	prefix, err := ip.Prefix(cachePrefixBits(ip))
+	if err != nil {
+		return ip.String()
+	}
+
+	return prefix.String()
+}
+
+// getIPGeoInfo looks up location, ISO country and ASN for ip using the
+// configured provider chain, works for both IPv4 and IPv6 addresses.
+func (g *GeoIpDatabase) getIPGeoInfo(ip netip.Addr) (GeoLocation, ISOCountry, ASN, error) {
+	return g.providers.Lookup(ip)
+}
+
+// getIPLatLong lookups up lat,long geo data from the configured geo provider, works for both IPv4 and IPv6 records
+func (g *GeoIpDatabase) getIPLatLong(ip *netip.Addr) (*GeoLocation, error) {
+	loc, _, _, err := g.getIPGeoInfo(*ip)
+	if err != nil {
+		return nil, err
 	}
 
-	return &GeoLocation{
-		Lat:  record.Location.Latitude,
-		Long: record.Location.Longitude,
-	}, nil
+	return &loc, nil
 }
 
-// GetDomainWithSmallestGeoDistance returns domain name with smallest geo distance of ip it resolves and client ip
-func (g *GeoIpDatabase) GetDomainWithSmallestGeoDistance(clientIp *netip.Addr, cacheTTLSec int) (string, error) {
-	if cacheTTLSec < 10 {
-		return "", fmt.Errorf("cache ttl can't be lower then 10 seconds: %d", cacheTTLSec)
+// PickBestDomain returns the hosting domain that scores best for clientIp
+// under the configured SelectionStrategy, combining geo distance, measured
+// RTT, health status and domain weight as the strategy dictates. Results are
+// cached per client /24 (IPv4) or /48 (IPv6) prefix, and concurrent misses for
+// the same prefix are collapsed into a single lookup.
+func (g *GeoIpDatabase) PickBestDomain(clientIp *netip.Addr) (string, error) {
+	cacheKey := cachePrefixKey(*clientIp)
+
+	if domain, ok := g.cache.Get(cacheKey); ok {
+		g.cacheHits.Inc()
+		return domain, nil
 	}
 
-	clientIpStr := clientIp.String()
-	inCache, exists := g.cache.Load(clientIpStr)
+	g.cacheMisses.Inc()
 
-	if exists {
-		return inCache.(GeoCacheEntry).Domain, nil
+	result, err, _ := g.cacheGroup.Do(cacheKey, func() (any, error) {
+		return g.pickBestDomainUncached(clientIp)
+	})
+	if err != nil {
+		return "", err
 	}
 
+	bestDomain := result.(string)
+	g.cachePrefixSize.Observe(float64(cachePrefixBits(clientIp.Unmap())))
+	g.cache.Add(cacheKey, bestDomain)
+
+	return bestDomain, nil
+}
+
+// pickBestDomainUncached runs the actual scoring pass over all known hosting
+// domains, bypassing the cache.
+func (g *GeoIpDatabase) pickBestDomainUncached(clientIp *netip.Addr) (string, error) {
+	return g.pickBestDomainFromPool(clientIp, nil)
+}
+
+// pickBestDomainFromPool runs the scoring pass restricted to pool, or over
+// all known hosting domains when pool is empty. Pool lookups bypass the
+// client-prefix cache, since the allowed domain set varies by rule.
+func (g *GeoIpDatabase) pickBestDomainFromPool(clientIp *netip.Addr, pool []string) (string, error) {
 	clientLocation, err := g.getIPLatLong(clientIp)
 	if err != nil {
 		return "", fmt.Errorf("failed to get client location: %w", err)
 	}
 
+	var allowed map[string]struct{}
+	if len(pool) > 0 {
+		allowed = make(map[string]struct{}, len(pool))
+		for _, domain := range pool {
+			allowed[domain] = struct{}{}
+		}
+	}
+
 	var bestDomain string
-	minDistance := math.MaxFloat64
+	bestScore := math.MaxFloat64
 
 	g.domainLocationsLock.RLock()
 	defer g.domainLocationsLock.RUnlock()
@@ -319,6 +531,12 @@ func (g *GeoIpDatabase) GetDomainWithSmallestGeoDistance(clientIp *netip.Addr, c
 			continue
 		}
 
+		if allowed != nil {
+			if _, ok := allowed[domain]; !ok {
+				continue
+			}
+		}
+
 		distance := HaversineDistance(
 			clientLocation.Lat,
 			clientLocation.Long,
@@ -326,8 +544,15 @@ func (g *GeoIpDatabase) GetDomainWithSmallestGeoDistance(clientIp *netip.Addr, c
 			hostLocation.Long,
 		)
 
-		if distance < minDistance {
-			minDistance = distance
+		score := g.scorer(DomainCandidate{
+			Domain:   domain,
+			Location: *hostLocation,
+			Distance: distance,
+			RTTMs:    g.getDomainRTT(domain),
+		})
+
+		if bestDomain == "" || score < bestScore {
+			bestScore = score
 			bestDomain = domain
 		}
 	}
@@ -336,17 +561,79 @@ func (g *GeoIpDatabase) GetDomainWithSmallestGeoDistance(clientIp *netip.Addr, c
 		return "", fmt.Errorf("all %d domains seem to be down", len(g.domainLocations))
 	}
 
-	if int(g.CacheLen.Load()) <= g.maxCacheSize {
-		g.CacheLen.Add(1)
-		g.cache.Store(
-			clientIp.String(),
-			GeoCacheEntry{
-				Domain:     bestDomain,
-				TTLSec:     cacheTTLSec,
-				InsertTime: time.Now().UTC(),
-			},
-		)
+	return bestDomain, nil
+}
+
+// DecisionKind is the outcome of Resolve: either a domain to redirect to, or
+// a request to deny.
+type DecisionKind string
+
+const (
+	DecisionRedirect DecisionKind = "redirect"
+	DecisionDeny     DecisionKind = "deny"
+)
+
+// Decision is the result of resolving a client against the configured rules
+// and, failing that, the haversine picker.
+type Decision struct {
+	Kind       DecisionKind
+	Domain     string
+	DenyStatus int
+}
+
+// Resolve decides how to handle clientIp: it evaluates the configured rules
+// first, in order, and falls back to PickBestDomain only when no rule
+// matches, a matched rule explicitly passes through, or a matched pin rule's
+// domain is marked down.
+func (g *GeoIpDatabase) Resolve(clientIp *netip.Addr) (Decision, error) {
+	if !g.rules.empty() {
+		country, asn := g.countryAndASN(clientIp)
+		if rule, ok := g.rules.match(*clientIp, country, asn); ok {
+			switch rule.action {
+			case RuleActionPin:
+				// A pinned domain that the health checker has marked down
+				// is no better than no rule at all: fall through to the
+				// haversine picker across every hosting domain instead of
+				// blindly redirecting into a known-dead target.
+				if g.domainIsAlive(rule.domain) {
+					return Decision{Kind: DecisionRedirect, Domain: rule.domain}, nil
+				}
+			case RuleActionDeny:
+				return Decision{Kind: DecisionDeny, DenyStatus: rule.denyStatus}, nil
+			case RuleActionPool:
+				domain, err := g.pickBestDomainFromPool(clientIp, rule.pool)
+				return Decision{Kind: DecisionRedirect, Domain: domain}, err
+			}
+			// RuleActionPassthrough, and a down RuleActionPin, fall through
+			// to the haversine picker below.
+		}
 	}
 
-	return bestDomain, nil
+	domain, err := g.PickBestDomain(clientIp)
+	return Decision{Kind: DecisionRedirect, Domain: domain}, err
+}
+
+// countryAndASN looks up the ISO country and ASN of clientIp for rule
+// matching; lookup failures just yield an empty country and zero ASN, so
+// only country/continent/ASN-scoped rules fail to match, not CIDR ones.
+func (g *GeoIpDatabase) countryAndASN(clientIp *netip.Addr) (ISOCountry, ASN) {
+	_, country, asn, err := g.getIPGeoInfo(*clientIp)
+	if err != nil {
+		return "", 0
+	}
+	return country, asn
+}
+
+// domainIsAlive reports whether domain is currently considered healthy; an
+// unknown domain (not yet in domainLocations) is treated as alive so a pin
+// rule still works before the first location/health update has run.
+func (g *GeoIpDatabase) domainIsAlive(domain string) bool {
+	g.domainLocationsLock.RLock()
+	defer g.domainLocationsLock.RUnlock()
+
+	location, ok := g.domainLocations[domain]
+	if !ok || location == nil {
+		return true
+	}
+	return location.IsAlive
 }
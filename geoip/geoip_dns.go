@@ -37,7 +37,7 @@ func (d *DnsResolver) StartCacheCleaner() {
 
 }
 
-// Resolve checks cache if hit returns ip if not resolves dns query A record for IPv4 and caches it
+// Resolve checks cache if hit returns ip if not resolves dns query (A, falling back to AAAA) and caches it
 func (d *DnsResolver) Resolve(hostname string, cacheTTLSec int) (*netip.Addr, error) {
 	if cacheTTLSec < 10 {
 		return nil, fmt.Errorf("ttl can not be smaller then 10: %d", cacheTTLSec)
@@ -50,7 +50,30 @@ func (d *DnsResolver) Resolve(hostname string, cacheTTLSec int) (*netip.Addr, er
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
+	ips, err := lookupDomainIPs(ctx, hostname)
+	if err != nil {
+		return nil, err
+	}
+
+	d.cache.Store(
+		hostname,
+		DnsCacheEntry{
+			Ips:        ips,
+			InsertTime: time.Now().UTC(),
+			TTLSec:     cacheTTLSec,
+		},
+	)
+
+	return &ips[0], nil
+}
+
+// lookupDomainIPs resolves a hostname's A records, falling back to AAAA when
+// the domain is only reachable over IPv6.
+func lookupDomainIPs(ctx context.Context, hostname string) ([]netip.Addr, error) {
 	hostIps, err := net.DefaultResolver.LookupIP(ctx, "ip4", hostname)
+	if err != nil || len(hostIps) == 0 {
+		hostIps, err = net.DefaultResolver.LookupIP(ctx, "ip6", hostname)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -63,20 +86,11 @@ func (d *DnsResolver) Resolve(hostname string, cacheTTLSec int) (*netip.Addr, er
 	for _, ip := range hostIps {
 		hostNetIp, ok := netip.AddrFromSlice(ip)
 		if !ok {
-			return nil, fmt.Errorf("failed to convert net.IP to netip.Addr: %s", hostIps[0].String())
+			return nil, fmt.Errorf("failed to convert net.IP to netip.Addr: %s", ip.String())
 		}
 
 		ips = append(ips, hostNetIp)
 	}
 
-	d.cache.Store(
-		hostname,
-		DnsCacheEntry{
-			Ips:        ips,
-			InsertTime: time.Now().UTC(),
-			TTLSec:     cacheTTLSec,
-		},
-	)
-
-	return &ips[0], nil
+	return ips, nil
 }
@@ -0,0 +1,252 @@
+package geoip
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// HealthCheckConfig controls how GeoIpDatabase actively probes hosting
+// domains, and how many consecutive successes/failures it takes to flip a
+// domain's health state, mirroring HAProxy's rise/fall model.
+type HealthCheckConfig struct {
+	Scheme             string            `json:"scheme,omitempty"`
+	InsecureSkipVerify bool              `json:"insecure_skip_verify,omitempty"`
+	Method             string            `json:"method,omitempty"`
+	Path               string            `json:"path,omitempty"`
+	Headers            map[string]string `json:"headers,omitempty"`
+	ExpectedStatuses   []int             `json:"expected_statuses,omitempty"`
+	ExpectedBodyRegex  string            `json:"expected_body_regex,omitempty"`
+	TimeoutSeconds     int               `json:"timeout_seconds,omitempty"`
+	// Rise is the number of consecutive successful probes required before a
+	// down domain is marked healthy again.
+	Rise int `json:"rise,omitempty"`
+	// Fall is the number of consecutive failed probes (active or passive)
+	// required before a healthy domain is marked down.
+	Fall int `json:"fall,omitempty"`
+	// IntervalSeconds is how often each hosting domain is actively probed.
+	// It defaults to 30s when unset or non-positive; any positive value is
+	// used as given.
+	IntervalSeconds int `json:"interval_seconds,omitempty"`
+}
+
+func (c HealthCheckConfig) accepts(statusCode int) bool {
+	if len(c.ExpectedStatuses) == 0 {
+		return statusCode >= 200 && statusCode < 400
+	}
+	for _, expected := range c.ExpectedStatuses {
+		if expected == statusCode {
+			return true
+		}
+	}
+	return false
+}
+
+// domainHealthState debounces probe outcomes for one domain against the
+// configured rise/fall thresholds. up holds the domain's last-settled
+// verdict; it only flips once the opposing streak reaches its threshold,
+// so an isolated blip on an otherwise-healthy domain doesn't flap it.
+type domainHealthState struct {
+	mu                   sync.Mutex
+	up                   bool
+	consecutiveSuccesses int
+	consecutiveFailures  int
+}
+
+func (st *domainHealthState) recordSuccess(rise int) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.consecutiveFailures = 0
+	st.consecutiveSuccesses++
+
+	if !st.up && st.consecutiveSuccesses >= rise {
+		st.up = true
+	}
+
+	return st.up
+}
+
+func (st *domainHealthState) recordFailure(fall int) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.consecutiveSuccesses = 0
+	st.consecutiveFailures++
+
+	if st.up && st.consecutiveFailures >= fall {
+		st.up = false
+	}
+
+	return st.up
+}
+
+// HealthChecker actively probes hosting domains per HealthCheckConfig, and
+// also accepts passive failure signals observed from real user traffic,
+// acting as a circuit breaker that can mark a domain down before its next
+// active probe runs.
+type HealthChecker struct {
+	cfg        HealthCheckConfig
+	bodyRegexp *regexp.Regexp
+	client     *http.Client
+
+	mu     sync.Mutex
+	states map[string]*domainHealthState
+
+	domainUp      *prometheus.GaugeVec
+	checkDuration *prometheus.HistogramVec
+}
+
+// NewHealthChecker builds a HealthChecker from cfg, registering its
+// Prometheus metrics on registry if non-nil.
+func NewHealthChecker(cfg HealthCheckConfig, registry *prometheus.Registry) (*HealthChecker, error) {
+	if cfg.Scheme == "" {
+		cfg.Scheme = "http"
+	}
+	if cfg.Method == "" {
+		cfg.Method = http.MethodGet
+	}
+	if cfg.TimeoutSeconds <= 0 {
+		cfg.TimeoutSeconds = 4
+	}
+	if cfg.Rise <= 0 {
+		cfg.Rise = 1
+	}
+	if cfg.Fall <= 0 {
+		cfg.Fall = 1
+	}
+	if cfg.IntervalSeconds <= 0 {
+		cfg.IntervalSeconds = 30
+	}
+
+	var bodyRegexp *regexp.Regexp
+	if cfg.ExpectedBodyRegex != "" {
+		var err error
+		bodyRegexp, err = regexp.Compile(cfg.ExpectedBodyRegex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expected_body_regex: %w", err)
+		}
+	}
+
+	var transport http.RoundTripper
+	if cfg.InsecureSkipVerify {
+		transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	}
+
+	domainUp := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "caddy_geo_redirect_domain_up",
+		Help: "Whether a hosting domain is currently considered healthy (1) or down (0).",
+	}, []string{"domain"})
+	checkDuration := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "caddy_geo_redirect_health_check_duration_seconds",
+		Help: "Duration of active health check requests against hosting domains.",
+	}, []string{"domain"})
+	if registry != nil {
+		registry.MustRegister(domainUp, checkDuration)
+	}
+
+	return &HealthChecker{
+		cfg:        cfg,
+		bodyRegexp: bodyRegexp,
+		client: &http.Client{
+			Timeout:   time.Duration(cfg.TimeoutSeconds) * time.Second,
+			Transport: transport,
+		},
+		states:        make(map[string]*domainHealthState),
+		domainUp:      domainUp,
+		checkDuration: checkDuration,
+	}, nil
+}
+
+// Interval returns how often active probes should run, per IntervalSeconds.
+func (h *HealthChecker) Interval() time.Duration {
+	return time.Duration(h.cfg.IntervalSeconds) * time.Second
+}
+
+func (h *HealthChecker) stateFor(domain string) *domainHealthState {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	st, ok := h.states[domain]
+	if !ok {
+		st = &domainHealthState{}
+		h.states[domain] = st
+	}
+
+	return st
+}
+
+func (h *HealthChecker) succeed(domain string) bool {
+	alive := h.stateFor(domain).recordSuccess(h.cfg.Rise)
+	h.setAlive(domain, alive)
+	return alive
+}
+
+func (h *HealthChecker) fail(domain string) bool {
+	alive := h.stateFor(domain).recordFailure(h.cfg.Fall)
+	h.setAlive(domain, alive)
+	return alive
+}
+
+func (h *HealthChecker) setAlive(domain string, alive bool) {
+	if alive {
+		h.domainUp.WithLabelValues(domain).Set(1)
+	} else {
+		h.domainUp.WithLabelValues(domain).Set(0)
+	}
+}
+
+// Probe actively health-checks domain per the configured HealthCheckConfig,
+// returning the domain's debounced liveness, the probe's round-trip time
+// (zero if no response was received), and the error that caused a failure,
+// if any.
+func (h *HealthChecker) Probe(domain string) (alive bool, rtt time.Duration, err error) {
+	uri := url.URL{Scheme: h.cfg.Scheme, Host: domain, Path: h.cfg.Path}
+
+	req, reqErr := http.NewRequest(h.cfg.Method, uri.String(), nil)
+	if reqErr != nil {
+		return h.fail(domain), 0, reqErr
+	}
+	for key, value := range h.cfg.Headers {
+		req.Header.Set(key, value)
+	}
+
+	start := time.Now()
+	resp, doErr := h.client.Do(req)
+	if doErr != nil {
+		return h.fail(domain), 0, doErr
+	}
+	defer resp.Body.Close()
+	rtt = time.Since(start)
+
+	if !h.cfg.accepts(resp.StatusCode) {
+		return h.fail(domain), rtt, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	if h.bodyRegexp != nil {
+		body, readErr := io.ReadAll(resp.Body)
+		if readErr != nil || !h.bodyRegexp.Match(body) {
+			return h.fail(domain), rtt, fmt.Errorf("response body did not match expected_body_regex")
+		}
+	}
+
+	return h.succeed(domain), rtt, nil
+}
+
+// RecordPassiveResult feeds a passive health signal observed from real user
+// traffic (e.g. the status code of a response actually served for domain)
+// into the circuit breaker, letting a domain that starts failing real
+// traffic be marked down before its next active probe runs.
+func (h *HealthChecker) RecordPassiveResult(domain string, statusCode int) bool {
+	if h.cfg.accepts(statusCode) {
+		return h.succeed(domain)
+	}
+	return h.fail(domain)
+}
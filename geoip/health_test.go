@@ -0,0 +1,77 @@
+package geoip
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDomainHealthStateRiseFall(t *testing.T) {
+	const rise, fall = 3, 3
+
+	st := &domainHealthState{}
+
+	// A fresh domain starts down and needs a full Rise streak before it's
+	// considered alive.
+	if alive := st.recordSuccess(rise); alive {
+		t.Fatalf("recordSuccess() #1 = true, want false (rise not yet reached)")
+	}
+	if alive := st.recordSuccess(rise); alive {
+		t.Fatalf("recordSuccess() #2 = true, want false (rise not yet reached)")
+	}
+	if alive := st.recordSuccess(rise); !alive {
+		t.Fatalf("recordSuccess() #3 = false, want true (rise reached)")
+	}
+
+	// Ten more consecutive successes: still alive.
+	for i := 0; i < 10; i++ {
+		if alive := st.recordSuccess(rise); !alive {
+			t.Fatalf("recordSuccess() after settling up = false, want true")
+		}
+	}
+
+	// A single transient failure must not flip an already-up domain down.
+	if alive := st.recordFailure(fall); !alive {
+		t.Fatalf("recordFailure() after one blip = false, want true (fall not reached)")
+	}
+
+	// One recovered success: still alive, the blip never brought it down.
+	if alive := st.recordSuccess(rise); !alive {
+		t.Fatalf("recordSuccess() after recovering from blip = false, want true")
+	}
+
+	// Now drive it down with a full Fall streak of failures.
+	if alive := st.recordFailure(fall); !alive {
+		t.Fatalf("recordFailure() #1 = false, want true (fall not yet reached)")
+	}
+	if alive := st.recordFailure(fall); !alive {
+		t.Fatalf("recordFailure() #2 = false, want true (fall not yet reached)")
+	}
+	if alive := st.recordFailure(fall); alive {
+		t.Fatalf("recordFailure() #3 = true, want false (fall reached)")
+	}
+
+	// A single recovered success must not flip an already-down domain up.
+	if alive := st.recordSuccess(rise); alive {
+		t.Fatalf("recordSuccess() after one recovery = true, want false (rise not reached)")
+	}
+}
+
+func TestHealthCheckerIntervalDefault(t *testing.T) {
+	hc, err := NewHealthChecker(HealthCheckConfig{}, nil)
+	if err != nil {
+		t.Fatalf("NewHealthChecker() error = %v", err)
+	}
+	if want := 30 * time.Second; hc.Interval() != want {
+		t.Errorf("Interval() = %v, want %v", hc.Interval(), want)
+	}
+}
+
+func TestHealthCheckerIntervalConfigured(t *testing.T) {
+	hc, err := NewHealthChecker(HealthCheckConfig{IntervalSeconds: 5}, nil)
+	if err != nil {
+		t.Fatalf("NewHealthChecker() error = %v", err)
+	}
+	if want := 5 * time.Second; hc.Interval() != want {
+		t.Errorf("Interval() = %v, want %v", hc.Interval(), want)
+	}
+}
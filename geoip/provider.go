@@ -0,0 +1,93 @@
+package geoip
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// ISOCountry is a two-letter ISO 3166-1 alpha-2 country code, e.g. "US".
+type ISOCountry string
+
+// ASN is an autonomous system number.
+type ASN uint32
+
+// GeoProvider looks up geo location, country and ASN information for an IP
+// address. Concrete implementations wrap a specific geo database format so
+// operators can mix MaxMind, DB-IP, IP2Location or a static CIDR file without
+// changing the rest of the lookup pipeline.
+type GeoProvider interface {
+	Lookup(ip netip.Addr) (GeoLocation, ISOCountry, ASN, error)
+	Close() error
+}
+
+// ProviderType identifies which GeoProvider implementation a ProviderConfig
+// should be built into.
+type ProviderType string
+
+const (
+	ProviderTypeMaxMind     ProviderType = "maxmind"
+	ProviderTypeDBIP        ProviderType = "dbip"
+	ProviderTypeIP2Location ProviderType = "ip2location"
+	ProviderTypeStatic      ProviderType = "static"
+)
+
+// ProviderConfig describes one entry of a stacked geo_provider chain.
+type ProviderConfig struct {
+	Type ProviderType `json:"type"`
+	Path string       `json:"path"`
+}
+
+// newProvider builds the concrete GeoProvider for a single ProviderConfig entry.
+func newProvider(cfg ProviderConfig) (GeoProvider, error) {
+	switch cfg.Type {
+	case ProviderTypeMaxMind:
+		return NewMaxMindProvider(cfg.Path)
+	case ProviderTypeDBIP:
+		return NewDBIPProvider(cfg.Path)
+	case ProviderTypeIP2Location:
+		return NewIP2LocationProvider(cfg.Path)
+	case ProviderTypeStatic:
+		return NewStaticFileProvider(cfg.Path)
+	default:
+		return nil, fmt.Errorf("unknown geo_provider type: %q", cfg.Type)
+	}
+}
+
+// ProviderChain tries each GeoProvider in order and returns the first
+// successful lookup, so operators can stack e.g. a static override file in
+// front of a commercial mmdb.
+type ProviderChain struct {
+	providers []GeoProvider
+}
+
+// NewProviderChain returns a ProviderChain that tries providers in order.
+func NewProviderChain(providers ...GeoProvider) *ProviderChain {
+	return &ProviderChain{providers: providers}
+}
+
+func (c *ProviderChain) Lookup(ip netip.Addr) (GeoLocation, ISOCountry, ASN, error) {
+	var lastErr error
+	for _, provider := range c.providers {
+		loc, country, asn, err := provider.Lookup(ip)
+		if err == nil {
+			return loc, country, asn, nil
+		}
+		lastErr = err
+	}
+
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no geo providers configured")
+	}
+
+	return GeoLocation{}, "", 0, lastErr
+}
+
+func (c *ProviderChain) Close() error {
+	var firstErr error
+	for _, provider := range c.providers {
+		if err := provider.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,48 @@
+package geoip
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/oschwald/maxminddb-golang/v2"
+)
+
+type dbipRecord struct {
+	Location struct {
+		Latitude  float64 `maxminddb:"latitude"`
+		Longitude float64 `maxminddb:"longitude"`
+	} `maxminddb:"location"`
+	Country struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+// DBIPProvider looks up geo data from a DB-IP City Lite mmdb file. DB-IP City
+// Lite does not carry ASN information, so ASN is always 0.
+type DBIPProvider struct {
+	reader *maxminddb.Reader
+}
+
+// NewDBIPProvider opens the mmdb file at path.
+func NewDBIPProvider(path string) (*DBIPProvider, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load db-ip geoip db: %w", err)
+	}
+
+	return &DBIPProvider{reader: reader}, nil
+}
+
+func (p *DBIPProvider) Lookup(ip netip.Addr) (GeoLocation, ISOCountry, ASN, error) {
+	var record dbipRecord
+	if err := p.reader.Lookup(ip).Decode(&record); err != nil {
+		return GeoLocation{}, "", 0, fmt.Errorf("failed ip lookup: %w", err)
+	}
+
+	loc := GeoLocation{Lat: record.Location.Latitude, Long: record.Location.Longitude}
+	return loc, ISOCountry(record.Country.IsoCode), 0, nil
+}
+
+func (p *DBIPProvider) Close() error {
+	return p.reader.Close()
+}
@@ -0,0 +1,38 @@
+package geoip
+
+import (
+	"fmt"
+	"net/netip"
+
+	ip2location "github.com/ip2location/ip2location-go/v9"
+)
+
+// IP2LocationProvider looks up geo data from an IP2Location BIN database.
+type IP2LocationProvider struct {
+	db *ip2location.DB
+}
+
+// NewIP2LocationProvider opens the IP2Location BIN file at path.
+func NewIP2LocationProvider(path string) (*IP2LocationProvider, error) {
+	db, err := ip2location.OpenDB(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load ip2location db: %w", err)
+	}
+
+	return &IP2LocationProvider{db: db}, nil
+}
+
+func (p *IP2LocationProvider) Lookup(ip netip.Addr) (GeoLocation, ISOCountry, ASN, error) {
+	record, err := p.db.Get_all(ip.String())
+	if err != nil {
+		return GeoLocation{}, "", 0, fmt.Errorf("failed ip lookup: %w", err)
+	}
+
+	loc := GeoLocation{Lat: float64(record.Latitude), Long: float64(record.Longitude)}
+	return loc, ISOCountry(record.Country_short), 0, nil
+}
+
+func (p *IP2LocationProvider) Close() error {
+	p.db.Close()
+	return nil
+}
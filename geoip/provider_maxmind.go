@@ -0,0 +1,51 @@
+package geoip
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/oschwald/maxminddb-golang/v2"
+)
+
+type maxmindRecord struct {
+	Location struct {
+		Latitude  float64 `maxminddb:"latitude"`
+		Longitude float64 `maxminddb:"longitude"`
+	} `maxminddb:"location"`
+	Country struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Traits struct {
+		AutonomousSystemNumber uint32 `maxminddb:"autonomous_system_number"`
+	} `maxminddb:"traits"`
+}
+
+// MaxMindProvider looks up geo data from a MaxMind GeoLite2-City (or
+// GeoIP2-City) mmdb file.
+type MaxMindProvider struct {
+	reader *maxminddb.Reader
+}
+
+// NewMaxMindProvider opens the mmdb file at path.
+func NewMaxMindProvider(path string) (*MaxMindProvider, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load maxmind geoip db: %w", err)
+	}
+
+	return &MaxMindProvider{reader: reader}, nil
+}
+
+func (p *MaxMindProvider) Lookup(ip netip.Addr) (GeoLocation, ISOCountry, ASN, error) {
+	var record maxmindRecord
+	if err := p.reader.Lookup(ip).Decode(&record); err != nil {
+		return GeoLocation{}, "", 0, fmt.Errorf("failed ip lookup: %w", err)
+	}
+
+	loc := GeoLocation{Lat: record.Location.Latitude, Long: record.Location.Longitude}
+	return loc, ISOCountry(record.Country.IsoCode), ASN(record.Traits.AutonomousSystemNumber), nil
+}
+
+func (p *MaxMindProvider) Close() error {
+	return p.reader.Close()
+}
@@ -0,0 +1,85 @@
+package geoip
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// StaticEntry maps a single CIDR to a fixed geo location, country and ASN.
+// Useful for pinning known corporate ranges or filling gaps left by a
+// commercial database.
+type StaticEntry struct {
+	CIDR    string  `json:"cidr" yaml:"cidr"`
+	Lat     float64 `json:"lat" yaml:"lat"`
+	Long    float64 `json:"long" yaml:"long"`
+	Country string  `json:"country,omitempty" yaml:"country,omitempty"`
+	ASN     uint32  `json:"asn,omitempty" yaml:"asn,omitempty"`
+}
+
+type staticProviderEntry struct {
+	prefix  netip.Prefix
+	loc     GeoLocation
+	country ISOCountry
+	asn     ASN
+}
+
+// StaticFileProvider resolves IPs against a list of CIDR ranges loaded from a
+// JSON or YAML file (selected by file extension).
+type StaticFileProvider struct {
+	entries []staticProviderEntry
+}
+
+// NewStaticFileProvider loads and parses the CIDR mapping file at path.
+func NewStaticFileProvider(path string) (*StaticFileProvider, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read static geo file: %w", err)
+	}
+
+	var rawEntries []StaticEntry
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(raw, &rawEntries)
+	default:
+		err = json.Unmarshal(raw, &rawEntries)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse static geo file: %w", err)
+	}
+
+	entries := make([]staticProviderEntry, 0, len(rawEntries))
+	for _, e := range rawEntries {
+		prefix, err := netip.ParsePrefix(e.CIDR)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %q in static geo file: %w", e.CIDR, err)
+		}
+
+		entries = append(entries, staticProviderEntry{
+			prefix:  prefix,
+			loc:     GeoLocation{Lat: e.Lat, Long: e.Long},
+			country: ISOCountry(e.Country),
+			asn:     ASN(e.ASN),
+		})
+	}
+
+	return &StaticFileProvider{entries: entries}, nil
+}
+
+func (p *StaticFileProvider) Lookup(ip netip.Addr) (GeoLocation, ISOCountry, ASN, error) {
+	for _, e := range p.entries {
+		if e.prefix.Contains(ip) {
+			return e.loc, e.country, e.asn, nil
+		}
+	}
+
+	return GeoLocation{}, "", 0, fmt.Errorf("no static entry matches ip: %s", ip)
+}
+
+func (p *StaticFileProvider) Close() error {
+	return nil
+}
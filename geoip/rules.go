@@ -0,0 +1,203 @@
+package geoip
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// RuleAction is the outcome a matched Rule produces.
+type RuleAction string
+
+const (
+	// RuleActionPin redirects matching clients to a single domain,
+	// regardless of latency, e.g. steering EU visitors to an EU domain. If
+	// the health checker has marked that domain down, the normal picker
+	// across all hosting domains is used instead.
+	RuleActionPin RuleAction = "pin"
+	// RuleActionPool restricts the haversine picker to a subset of hosting
+	// domains, e.g. sending APAC traffic to an APAC pool.
+	RuleActionPool RuleAction = "pool"
+	// RuleActionDeny rejects matching clients with a fixed status code.
+	RuleActionDeny RuleAction = "deny"
+	// RuleActionPassthrough matches but defers to the normal haversine
+	// picker across all hosting domains, useful for carving exceptions out
+	// of a broader rule set.
+	RuleActionPassthrough RuleAction = "passthrough"
+)
+
+// Rule is a single geofencing override: if it matches a client, it decides
+// the response before the haversine picker ever runs. NewRuleSet rejects a
+// Rule with no matchers.
+type Rule struct {
+	Countries  []ISOCountry `json:"countries,omitempty"`
+	Continents []string     `json:"continents,omitempty"`
+	ASNs       []ASN        `json:"asns,omitempty"`
+	CIDRs      []string     `json:"cidrs,omitempty"`
+
+	Action     RuleAction `json:"action"`
+	Domain     string     `json:"domain,omitempty"`      // RuleActionPin
+	Pool       []string   `json:"pool,omitempty"`        // RuleActionPool
+	DenyStatus int        `json:"deny_status,omitempty"` // RuleActionDeny
+}
+
+// compiledRule is a Rule with its matchers indexed for fast lookup.
+type compiledRule struct {
+	countries  map[ISOCountry]struct{}
+	continents map[string]struct{}
+	asns       map[ASN]struct{}
+	cidrs      []netip.Prefix
+
+	action     RuleAction
+	domain     string
+	pool       []string
+	denyStatus int
+}
+
+// RuleSet is an ordered, compiled list of geofencing Rules; the first rule
+// that matches a client wins.
+type RuleSet struct {
+	rules []compiledRule
+}
+
+// NewRuleSet compiles rules, validating each one's matchers and action.
+func NewRuleSet(rules []Rule) (*RuleSet, error) {
+	compiled := make([]compiledRule, 0, len(rules))
+	for i, rule := range rules {
+		cr, err := compileRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i, err)
+		}
+		compiled = append(compiled, cr)
+	}
+
+	return &RuleSet{rules: compiled}, nil
+}
+
+func compileRule(rule Rule) (compiledRule, error) {
+	cr := compiledRule{
+		action:     rule.Action,
+		domain:     rule.Domain,
+		pool:       rule.Pool,
+		denyStatus: rule.DenyStatus,
+	}
+
+	if len(rule.Countries) > 0 {
+		cr.countries = make(map[ISOCountry]struct{}, len(rule.Countries))
+		for _, country := range rule.Countries {
+			cr.countries[ISOCountry(strings.ToUpper(string(country)))] = struct{}{}
+		}
+	}
+
+	if len(rule.Continents) > 0 {
+		cr.continents = make(map[string]struct{}, len(rule.Continents))
+		for _, continent := range rule.Continents {
+			cr.continents[strings.ToUpper(continent)] = struct{}{}
+		}
+	}
+
+	if len(rule.ASNs) > 0 {
+		cr.asns = make(map[ASN]struct{}, len(rule.ASNs))
+		for _, asn := range rule.ASNs {
+			cr.asns[asn] = struct{}{}
+		}
+	}
+
+	for _, cidr := range rule.CIDRs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return compiledRule{}, fmt.Errorf("invalid cidr %q: %w", cidr, err)
+		}
+		cr.cidrs = append(cr.cidrs, prefix)
+	}
+
+	if len(cr.countries) == 0 && len(cr.continents) == 0 && len(cr.asns) == 0 && len(cr.cidrs) == 0 {
+		return compiledRule{}, fmt.Errorf("rule has no countries, continents, asns or cidrs to match on")
+	}
+
+	switch cr.action {
+	case RuleActionPin:
+		if cr.domain == "" {
+			return compiledRule{}, fmt.Errorf("pin rule missing domain")
+		}
+	case RuleActionPool:
+		if len(cr.pool) == 0 {
+			return compiledRule{}, fmt.Errorf("pool rule missing pool")
+		}
+	case RuleActionDeny:
+		if cr.denyStatus == 0 {
+			cr.denyStatus = http.StatusForbidden
+		}
+	case RuleActionPassthrough:
+	default:
+		return compiledRule{}, fmt.Errorf("unknown rule action %q", cr.action)
+	}
+
+	return cr, nil
+}
+
+// matches reports whether every non-empty matcher on cr accepts ip, country,
+// continent and asn; a rule with no matchers at all would match everything,
+// but compileRule rejects such rules.
+func (cr compiledRule) matches(ip netip.Addr, country ISOCountry, continent string, asn ASN) bool {
+	// Unmap 4-in-6 addresses (e.g. ::ffff:a.b.c.d) so an IPv4 CIDR rule
+	// matches clients that arrived in IPv4-mapped-IPv6 form.
+	ip = ip.Unmap()
+
+	if cr.countries != nil {
+		if _, ok := cr.countries[country]; !ok {
+			return false
+		}
+	}
+
+	if cr.continents != nil {
+		if _, ok := cr.continents[continent]; !ok {
+			return false
+		}
+	}
+
+	if cr.asns != nil {
+		if _, ok := cr.asns[asn]; !ok {
+			return false
+		}
+	}
+
+	if len(cr.cidrs) > 0 {
+		matched := false
+		for _, prefix := range cr.cidrs {
+			if prefix.Contains(ip) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+// empty reports whether rs has no rules configured, so callers can skip
+// work (like an extra geo lookup) that only matters for rule matching.
+func (rs *RuleSet) empty() bool {
+	return rs == nil || len(rs.rules) == 0
+}
+
+// match returns the first rule matching ip/country/asn, or ok=false if none
+// match, in which case the caller should fall back to the haversine picker.
+func (rs *RuleSet) match(ip netip.Addr, country ISOCountry, asn ASN) (compiledRule, bool) {
+	if rs == nil {
+		return compiledRule{}, false
+	}
+
+	continent := continentForCountry(country)
+	for _, rule := range rs.rules {
+		if rule.matches(ip, country, continent, asn) {
+			return rule, true
+		}
+	}
+
+	return compiledRule{}, false
+}
@@ -0,0 +1,65 @@
+package geoip
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestCompiledRuleMatchesCIDR4In6(t *testing.T) {
+	rs, err := NewRuleSet([]Rule{
+		{
+			CIDRs:  []string{"192.0.2.0/24"},
+			Action: RuleActionPin,
+			Domain: "eu.example.com",
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewRuleSet() error = %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		ip        string
+		wantMatch bool
+	}{
+		{name: "plain IPv4 in range", ip: "192.0.2.5", wantMatch: true},
+		{name: "plain IPv4 out of range", ip: "203.0.113.5", wantMatch: false},
+		{name: "4-in-6 in range", ip: "::ffff:192.0.2.5", wantMatch: true},
+		{name: "4-in-6 out of range", ip: "::ffff:203.0.113.5", wantMatch: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip := netip.MustParseAddr(tt.ip)
+			_, ok := rs.match(ip, "", 0)
+			if ok != tt.wantMatch {
+				t.Errorf("match(%s) matched = %v, want %v", tt.ip, ok, tt.wantMatch)
+			}
+		})
+	}
+}
+
+func TestRuleSetEmpty(t *testing.T) {
+	var nilRules *RuleSet
+	if !nilRules.empty() {
+		t.Errorf("nil RuleSet.empty() = false, want true")
+	}
+
+	empty, err := NewRuleSet(nil)
+	if err != nil {
+		t.Fatalf("NewRuleSet(nil) error = %v", err)
+	}
+	if !empty.empty() {
+		t.Errorf("RuleSet with no rules: empty() = false, want true")
+	}
+
+	nonEmpty, err := NewRuleSet([]Rule{
+		{CIDRs: []string{"192.0.2.0/24"}, Action: RuleActionDeny},
+	})
+	if err != nil {
+		t.Fatalf("NewRuleSet() error = %v", err)
+	}
+	if nonEmpty.empty() {
+		t.Errorf("RuleSet with one rule: empty() = true, want false")
+	}
+}
@@ -0,0 +1,93 @@
+package geoip
+
+import "math"
+
+// SelectionStrategy controls which Scorer PickBestDomain uses to rank
+// candidate domains.
+type SelectionStrategy string
+
+const (
+	// SelectionStrategyGeo picks the domain with the smallest haversine
+	// distance to the client. This is the historical, default behaviour.
+	SelectionStrategyGeo SelectionStrategy = "geo"
+	// SelectionStrategyRTT picks the domain with the smallest measured RTT.
+	SelectionStrategyRTT SelectionStrategy = "rtt"
+	// SelectionStrategyWeighted picks the domain with the smallest
+	// distance/weight ratio, letting operators steer more traffic to
+	// higher-capacity domains.
+	SelectionStrategyWeighted SelectionStrategy = "weighted"
+	// SelectionStrategyHybrid mixes geo distance and measured RTT using a
+	// configurable mixing coefficient.
+	SelectionStrategyHybrid SelectionStrategy = "hybrid"
+)
+
+// DomainCandidate carries everything a Scorer needs to rank one hosting
+// domain for a given client lookup.
+type DomainCandidate struct {
+	Domain   string
+	Location DomainGeoLocation
+	Distance float64 // great-circle distance to the client, in km
+	// RTTMs is the domain's EWMA of measured RTT, in ms; 0 if no sample
+	// yet. It is a single global figure observed by the Caddy instance's
+	// own active probes, not a per-client measurement (see
+	// GeoIpDatabase.recordDomainRTT), so it approximates "how fast is this
+	// domain in general" rather than "how fast is this domain for this
+	// specific client".
+	RTTMs float64
+}
+
+// Scorer ranks a DomainCandidate; PickBestDomain picks the candidate with the
+// lowest score.
+type Scorer func(DomainCandidate) float64
+
+// GeoScorer ranks candidates purely by geo distance.
+func GeoScorer(c DomainCandidate) float64 {
+	return c.Distance
+}
+
+// RTTScorer ranks candidates by measured RTT, pushing domains with no RTT
+// sample yet to the back.
+func RTTScorer(c DomainCandidate) float64 {
+	if c.RTTMs <= 0 {
+		return math.MaxFloat64
+	}
+	return c.RTTMs
+}
+
+// WeightedScorer ranks candidates by distance divided by domain weight, so a
+// higher-weight (higher-capacity) domain wins over a closer but lower-weight
+// one.
+func WeightedScorer(c DomainCandidate) float64 {
+	weight := c.Location.Weight
+	if weight <= 0 {
+		weight = 1
+	}
+	return c.Distance / weight
+}
+
+// HybridScorer mixes geo distance and measured RTT, weighting RTT by
+// mixCoefficient (0 = pure geo, 1 = pure RTT). Falls back to geo distance
+// when no RTT sample has been collected yet for the candidate.
+func HybridScorer(mixCoefficient float64) Scorer {
+	return func(c DomainCandidate) float64 {
+		if c.RTTMs <= 0 {
+			return c.Distance
+		}
+		return (1-mixCoefficient)*c.Distance + mixCoefficient*c.RTTMs
+	}
+}
+
+// scorerForStrategy returns the Scorer backing a SelectionStrategy,
+// defaulting to GeoScorer for an empty or unrecognized strategy.
+func scorerForStrategy(strategy SelectionStrategy, mixCoefficient float64) Scorer {
+	switch strategy {
+	case SelectionStrategyRTT:
+		return RTTScorer
+	case SelectionStrategyWeighted:
+		return WeightedScorer
+	case SelectionStrategyHybrid:
+		return HybridScorer(mixCoefficient)
+	default:
+		return GeoScorer
+	}
+}
@@ -1,6 +1,7 @@
 package caddygeoredirect
 
 import (
+	"fmt"
 	"net"
 	"net/http"
 	"net/netip"
@@ -8,6 +9,7 @@ import (
 	"os"
 	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
@@ -25,17 +27,44 @@ func init() {
 	httpcaddyfile.RegisterHandlerDirective("geo_based_redirect", parseCaddyfile)
 }
 
+// ClientIPStrategy controls how the middleware determines the client's IP
+// address for the geo lookup.
+type ClientIPStrategy string
+
+const (
+	// ClientIPStrategyRemoteAddr uses the TCP connection's remote address. This
+	// is correct when Caddy terminates connections directly from clients.
+	ClientIPStrategyRemoteAddr ClientIPStrategy = "remote_addr"
+	// ClientIPStrategyXFF reads the client IP out of the X-Forwarded-For
+	// header, skipping hops that belong to a configured trusted proxy.
+	ClientIPStrategyXFF ClientIPStrategy = "xff"
+	// ClientIPStrategyCFConnectingIP reads the client IP from the
+	// Cf-Connecting-Ip header set by Cloudflare.
+	ClientIPStrategyCFConnectingIP ClientIPStrategy = "cf_connecting_ip"
+)
+
 type Middleware struct {
-	MmdbPath               string   `json:"mmdb_path,omitempty"`
-	MmdbUri                string   `json:"mmdb_uri,omitempty"`
-	MmdbDownloadPeriodDays int      `json:"mmdb_download_period_days,omitempty"`
-	DomainNames            []string `json:"domain_names,omitempty"`
-	MaxCacheSize           int      `json:"max_cache_size,omitempty"`
-	CacheTTLSeconds        int      `json:"cache_ttl_seconds,omitempty"`
-	HealthUri              string   `json:"health_uri,omitempty"`
+	MmdbPath               string                  `json:"mmdb_path,omitempty"`
+	MmdbUri                string                  `json:"mmdb_uri,omitempty"`
+	MmdbSha256             string                  `json:"mmdb_sha256,omitempty"`
+	MmdbDownloadPeriodDays int                     `json:"mmdb_download_period_days,omitempty"`
+	DomainNames            []string                `json:"domain_names,omitempty"`
+	MaxCacheSize           int                     `json:"max_cache_size,omitempty"`
+	CacheTTLSeconds        int                     `json:"cache_ttl_seconds,omitempty"`
+	HealthUri              string                  `json:"health_uri,omitempty"`
+	HealthCheck            geoip.HealthCheckConfig `json:"health_check,omitempty"`
+	ClientIPStrategy       ClientIPStrategy        `json:"client_ip_strategy,omitempty"`
+	TrustedProxies         []string                `json:"trusted_proxies,omitempty"`
+	XFFDepth               int                     `json:"xff_depth,omitempty"`
+	GeoProviders           []geoip.ProviderConfig  `json:"geo_providers,omitempty"`
+	SelectionStrategy      geoip.SelectionStrategy `json:"selection_strategy,omitempty"`
+	MixCoefficient         float64                 `json:"mix_coefficient,omitempty"`
+	DomainWeights          map[string]float64      `json:"domain_weights,omitempty"`
+	Rules                  []geoip.Rule            `json:"rules,omitempty"`
 	GeoIP                  *geoip.GeoIpDatabase
 	logger                 *zap.Logger
 	redirectCounterMetrics *prometheus.CounterVec
+	trustedProxyNets       []netip.Prefix
 }
 
 func (Middleware) CaddyModule() caddy.ModuleInfo {
@@ -60,23 +89,55 @@ func (m *Middleware) Provision(ctx caddy.Context) error {
 		m.MmdbDownloadPeriodDays = 30
 	}
 
+	if m.ClientIPStrategy == "" {
+		m.ClientIPStrategy = ClientIPStrategyRemoteAddr
+	}
+
+	if m.XFFDepth == 0 {
+		m.XFFDepth = 1
+	}
+
+	if m.SelectionStrategy == "" {
+		m.SelectionStrategy = geoip.SelectionStrategyGeo
+	}
+
+	if m.HealthCheck.Path == "" {
+		m.HealthCheck.Path = m.HealthUri
+	}
+
+	m.trustedProxyNets = make([]netip.Prefix, 0, len(m.TrustedProxies))
+	for _, cidr := range m.TrustedProxies {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid trusted_proxies cidr %q: %w", cidr, err)
+		}
+		m.trustedProxyNets = append(m.trustedProxyNets, prefix)
+	}
+
 	var err error
 	m.GeoIP, err = geoip.NewGeoIpDatabase(
 		&geoip.NewGeoIpDatabaseArgs{
 			Logger:                   m.logger,
 			MmdbPathUri:              m.MmdbUri,
 			MmdbPath:                 m.MmdbPath,
+			MmdbSha256:               m.MmdbSha256,
 			MmdbPeriodicDownloadDays: m.MmdbDownloadPeriodDays,
 			MaxCacheSize:             m.MaxCacheSize,
+			CacheTTLSeconds:          m.CacheTTLSeconds,
 			HostingDomains:           m.DomainNames,
-			HealthUri:                m.HealthUri,
+			HealthCheck:              m.HealthCheck,
+			MetricsRegistry:          ctx.GetMetricsRegistry(),
+			Providers:                m.GeoProviders,
+			SelectionStrategy:        m.SelectionStrategy,
+			MixCoefficient:           m.MixCoefficient,
+			DomainWeights:            m.DomainWeights,
+			Rules:                    m.Rules,
 		},
 	)
 	if err != nil {
 		return err
 	}
 	m.GeoIP.StartDomainLocationAndHeathCheckUpdater(time.Hour)
-	m.GeoIP.StartCacheCleanup()
 
 	if m.MmdbUri != "" && m.MmdbDownloadPeriodDays > 0 {
 		m.GeoIP.StartPeriodicGeoDBSyncer()
@@ -91,6 +152,7 @@ func (m *Middleware) Provision(ctx caddy.Context) error {
 	)
 	m.redirectCounterMetrics.WithLabelValues("failed")
 	m.redirectCounterMetrics.WithLabelValues("success")
+	m.redirectCounterMetrics.WithLabelValues("denied")
 	ctx.GetMetricsRegistry().MustRegister(m.redirectCounterMetrics)
 
 	return nil
@@ -104,14 +166,28 @@ func (m *Middleware) Validate() error {
 		}
 	}
 
+	switch m.ClientIPStrategy {
+	case "", ClientIPStrategyRemoteAddr, ClientIPStrategyXFF, ClientIPStrategyCFConnectingIP:
+	default:
+		return fmt.Errorf("unknown client_ip_strategy %q", m.ClientIPStrategy)
+	}
+
+	switch m.SelectionStrategy {
+	case "", geoip.SelectionStrategyGeo, geoip.SelectionStrategyRTT, geoip.SelectionStrategyWeighted, geoip.SelectionStrategyHybrid:
+	default:
+		return fmt.Errorf("unknown selection_strategy %q", m.SelectionStrategy)
+	}
+
 	if m.HealthUri != "" {
 		if _, err := url.ParseRequestURI(m.HealthUri); err != nil {
 			return err
 		}
 	}
 
-	if _, err := os.Stat(m.MmdbPath); os.IsNotExist(err) && m.MmdbUri == "" {
-		return err
+	if len(m.GeoProviders) == 0 {
+		if _, err := os.Stat(m.MmdbPath); os.IsNotExist(err) && m.MmdbUri == "" {
+			return err
+		}
 	}
 
 	return nil
@@ -129,40 +205,145 @@ func (m Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddy
 		return next.ServeHTTP(w, r)
 	}
 
-	clientIP, err := netip.ParseAddr(r.RemoteAddr)
+	clientIP, err := m.extractClientIP(r)
 	if err != nil {
-		m.logger.Error("Can't parse remote address", zap.Error(err), zap.String("ip", r.RemoteAddr))
+		m.logger.Error("Can't determine client ip", zap.Error(err), zap.String("remote_addr", r.RemoteAddr))
 		return next.ServeHTTP(w, r)
 	}
 
-	// We do not support IPv6 so we just skip it
-	if clientIP.Is6() && clientIP.IsPrivate() {
-		m.logger.Debug("Found IPv6 or private ip skipping redirect check", zap.String("ip", clientIP.String()))
-		return next.ServeHTTP(w, r)
-	}
-
-	redirectDomain, err := m.GeoIP.GetDomainWithSmallestGeoDistance(
-		&clientIP,
-		m.CacheTTLSeconds,
-	)
-
+	decision, err := m.GeoIP.Resolve(&clientIP)
 	if err != nil {
 		m.logger.Error("failed to get ip distance", zap.Error(err))
 		m.redirectCounterMetrics.WithLabelValues("failed").Inc()
 		return next.ServeHTTP(w, r)
 	}
 
+	if decision.Kind == geoip.DecisionDeny {
+		m.logger.Debug("Denying request by geofencing rule", zap.Int("status", decision.DenyStatus))
+		m.redirectCounterMetrics.WithLabelValues("denied").Inc()
+		w.WriteHeader(decision.DenyStatus)
+		return nil
+	}
+
+	redirectDomain := decision.Domain
 	if redirectDomain != r.Host {
 		m.logger.Debug("Found domain that has smaller latency", zap.String("domain", redirectDomain))
 		redirectFullUrl := r.URL
 		redirectFullUrl.Host = redirectDomain
 		redirectFullUrlStr := redirectFullUrl.String()
-		m.logger.Debug("Redirecting to", zap.String("url", redirectFullUrlStr), zap.Uint64("cache_len", m.GeoIP.CacheLen.Load()))
+		m.logger.Debug("Redirecting to", zap.String("url", redirectFullUrlStr), zap.Int("cache_len", m.GeoIP.CacheLen()))
 		m.redirectCounterMetrics.WithLabelValues("success").Inc()
 		http.Redirect(w, r, redirectFullUrlStr, http.StatusFound)
+		return next.ServeHTTP(w, r)
 	}
 
-	return next.ServeHTTP(w, r)
+	// We're serving this domain's own traffic locally: feed the response
+	// status back into the health checker's passive circuit breaker so a
+	// domain that starts failing real requests is marked down without
+	// waiting for the next active probe.
+	rec := &statusCapturingResponseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+	err = next.ServeHTTP(rec, r)
+	m.GeoIP.RecordPassiveHealthSignal(r.Host, rec.statusCode)
+	return err
+}
+
+// statusCapturingResponseWriter wraps an http.ResponseWriter to record the
+// status code the next handler writes.
+type statusCapturingResponseWriter struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func (w *statusCapturingResponseWriter) WriteHeader(statusCode int) {
+	w.statusCode = statusCode
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *statusCapturingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// extractClientIP resolves the client IP according to the configured
+// ClientIPStrategy.
+func (m *Middleware) extractClientIP(r *http.Request) (netip.Addr, error) {
+	switch m.ClientIPStrategy {
+	case ClientIPStrategyXFF:
+		return m.extractClientIPFromXFF(r)
+	case ClientIPStrategyCFConnectingIP:
+		return extractClientIPFromHeader(r, "Cf-Connecting-Ip")
+	default:
+		return remoteAddrIP(r.RemoteAddr)
+	}
+}
+
+// extractClientIPFromXFF walks the X-Forwarded-For header from right to
+// left, skipping hops that belong to a trusted proxy, and returns the
+// XFFDepth-th untrusted address it finds.
+func (m *Middleware) extractClientIPFromXFF(r *http.Request) (netip.Addr, error) {
+	header := r.Header.Get("X-Forwarded-For")
+	if header == "" {
+		return remoteAddrIP(r.RemoteAddr)
+	}
+
+	parts := strings.Split(header, ",")
+	ips := make([]netip.Addr, 0, len(parts))
+	for _, part := range parts {
+		ip, err := netip.ParseAddr(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		ips = append(ips, ip)
+	}
+
+	if len(ips) == 0 {
+		return remoteAddrIP(r.RemoteAddr)
+	}
+
+	untrustedSeen := 0
+	for i := len(ips) - 1; i >= 0; i-- {
+		if m.isTrustedProxy(ips[i]) {
+			continue
+		}
+		untrustedSeen++
+		if untrustedSeen == m.XFFDepth {
+			return ips[i], nil
+		}
+	}
+
+	return ips[0], nil
+}
+
+// isTrustedProxy reports whether ip falls within one of the configured
+// TrustedProxies CIDRs.
+func (m *Middleware) isTrustedProxy(ip netip.Addr) bool {
+	for _, prefix := range m.trustedProxyNets {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// extractClientIPFromHeader reads the client IP out of a single-value
+// header, falling back to the remote address when the header is absent.
+func extractClientIPFromHeader(r *http.Request, header string) (netip.Addr, error) {
+	val := r.Header.Get(header)
+	if val == "" {
+		return remoteAddrIP(r.RemoteAddr)
+	}
+	return netip.ParseAddr(strings.TrimSpace(val))
+}
+
+// remoteAddrIP parses the IP portion out of an http.Request.RemoteAddr,
+// which is usually in "ip:port" form.
+func remoteAddrIP(remoteAddr string) (netip.Addr, error) {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	return netip.ParseAddr(host)
 }
 
 func (m *Middleware) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
@@ -182,6 +363,11 @@ func (m *Middleware) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 					return d.ArgErr()
 				}
 				m.MmdbUri = d.Val()
+			case "mmdb_sha256":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.MmdbSha256 = d.Val()
 			case "mmdb_download_period_days":
 				if !d.NextArg() {
 					return d.ArgErr()
@@ -219,6 +405,69 @@ func (m *Middleware) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 					return d.ArgErr()
 				}
 				m.HealthUri = d.Val()
+			case "health_check":
+				if err := m.unmarshalHealthCheck(d); err != nil {
+					return err
+				}
+			case "client_ip_strategy":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.ClientIPStrategy = ClientIPStrategy(d.Val())
+			case "trusted_proxies":
+				m.TrustedProxies = d.RemainingArgs()
+				if len(m.TrustedProxies) == 0 {
+					return d.ArgErr()
+				}
+			case "xff_depth":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				depth, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid integer for xff_depth: %v", err)
+				}
+				m.XFFDepth = depth
+			case "geo_provider":
+				providerArgs := d.RemainingArgs()
+				if len(providerArgs) != 2 {
+					return d.ArgErr()
+				}
+				m.GeoProviders = append(m.GeoProviders, geoip.ProviderConfig{
+					Type: geoip.ProviderType(providerArgs[0]),
+					Path: providerArgs[1],
+				})
+			case "selection_strategy":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.SelectionStrategy = geoip.SelectionStrategy(d.Val())
+			case "mix_coefficient":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				coefficient, err := strconv.ParseFloat(d.Val(), 64)
+				if err != nil {
+					return d.Errf("invalid float for mix_coefficient: %v", err)
+				}
+				m.MixCoefficient = coefficient
+			case "domain_weight":
+				weightArgs := d.RemainingArgs()
+				if len(weightArgs) != 2 {
+					return d.ArgErr()
+				}
+				weight, err := strconv.ParseFloat(weightArgs[1], 64)
+				if err != nil {
+					return d.Errf("invalid float for domain_weight: %v", err)
+				}
+				if m.DomainWeights == nil {
+					m.DomainWeights = make(map[string]float64)
+				}
+				m.DomainWeights[weightArgs[0]] = weight
+			case "rules":
+				if err := m.unmarshalRules(d); err != nil {
+					return err
+				}
 			default:
 				return d.Errf("unrecognized subdirective '%s'", d.Val())
 			}
@@ -227,6 +476,196 @@ func (m *Middleware) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	return nil
 }
 
+// unmarshalHealthCheck parses the health_check subdirective's nested block,
+// configuring the active health checker's scheme/method/expectations and
+// HAProxy-style rise/fall thresholds.
+func (m *Middleware) unmarshalHealthCheck(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "scheme":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.HealthCheck.Scheme = d.Val()
+		case "insecure_skip_verify":
+			m.HealthCheck.InsecureSkipVerify = true
+		case "method":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.HealthCheck.Method = d.Val()
+		case "path":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.HealthCheck.Path = d.Val()
+		case "expected_status":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			for _, arg := range args {
+				code, err := strconv.Atoi(arg)
+				if err != nil {
+					return d.Errf("invalid integer for expected_status: %v", err)
+				}
+				m.HealthCheck.ExpectedStatuses = append(m.HealthCheck.ExpectedStatuses, code)
+			}
+		case "expected_body_regex":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.HealthCheck.ExpectedBodyRegex = d.Val()
+		case "header":
+			headerArgs := d.RemainingArgs()
+			if len(headerArgs) != 2 {
+				return d.ArgErr()
+			}
+			if m.HealthCheck.Headers == nil {
+				m.HealthCheck.Headers = make(map[string]string)
+			}
+			m.HealthCheck.Headers[headerArgs[0]] = headerArgs[1]
+		case "timeout_seconds":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			timeout, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid integer for timeout_seconds: %v", err)
+			}
+			m.HealthCheck.TimeoutSeconds = timeout
+		case "interval_seconds":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			interval, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid integer for interval_seconds: %v", err)
+			}
+			m.HealthCheck.IntervalSeconds = interval
+		case "rise":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			rise, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid integer for rise: %v", err)
+			}
+			m.HealthCheck.Rise = rise
+		case "fall":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			fall, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid integer for fall: %v", err)
+			}
+			m.HealthCheck.Fall = fall
+		default:
+			return d.Errf("unrecognized health_check subdirective '%s'", d.Val())
+		}
+	}
+	return nil
+}
+
+// unmarshalRules parses the rules subdirective's nested "rule" blocks, each
+// one a geofencing override matched on country/continent/asn/cidr.
+func (m *Middleware) unmarshalRules(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		if d.Val() != "rule" {
+			return d.Errf("unrecognized rules subdirective '%s'", d.Val())
+		}
+		rule, err := unmarshalRule(d)
+		if err != nil {
+			return err
+		}
+		m.Rules = append(m.Rules, rule)
+	}
+	return nil
+}
+
+// unmarshalRule parses a single "rule { ... }" block.
+func unmarshalRule(d *caddyfile.Dispenser) (geoip.Rule, error) {
+	var rule geoip.Rule
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "countries":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return rule, d.ArgErr()
+			}
+			for _, arg := range args {
+				rule.Countries = append(rule.Countries, geoip.ISOCountry(arg))
+			}
+		case "continents":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return rule, d.ArgErr()
+			}
+			rule.Continents = append(rule.Continents, args...)
+		case "asns":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return rule, d.ArgErr()
+			}
+			for _, arg := range args {
+				asn, err := strconv.ParseUint(arg, 10, 32)
+				if err != nil {
+					return rule, d.Errf("invalid integer for asns: %v", err)
+				}
+				rule.ASNs = append(rule.ASNs, geoip.ASN(asn))
+			}
+		case "cidrs":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return rule, d.ArgErr()
+			}
+			rule.CIDRs = append(rule.CIDRs, args...)
+		case "action":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return rule, d.ArgErr()
+			}
+			switch geoip.RuleAction(args[0]) {
+			case geoip.RuleActionPin:
+				if len(args) != 2 {
+					return rule, d.ArgErr()
+				}
+				rule.Action = geoip.RuleActionPin
+				rule.Domain = args[1]
+			case geoip.RuleActionPool:
+				if len(args) < 2 {
+					return rule, d.ArgErr()
+				}
+				rule.Action = geoip.RuleActionPool
+				rule.Pool = args[1:]
+			case geoip.RuleActionDeny:
+				if len(args) > 2 {
+					return rule, d.ArgErr()
+				}
+				rule.Action = geoip.RuleActionDeny
+				if len(args) == 2 {
+					status, err := strconv.Atoi(args[1])
+					if err != nil {
+						return rule, d.Errf("invalid integer for deny status: %v", err)
+					}
+					rule.DenyStatus = status
+				}
+			case geoip.RuleActionPassthrough:
+				if len(args) != 1 {
+					return rule, d.ArgErr()
+				}
+				rule.Action = geoip.RuleActionPassthrough
+			default:
+				return rule, d.Errf("unknown rule action %q", args[0])
+			}
+		default:
+			return rule, d.Errf("unrecognized rule subdirective '%s'", d.Val())
+		}
+	}
+	return rule, nil
+}
+
 func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
 	var m Middleware
 	err := m.UnmarshalCaddyfile(h.Dispenser)
@@ -0,0 +1,180 @@
+package caddygeoredirect
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func mustPrefix(t *testing.T, cidr string) netip.Prefix {
+	t.Helper()
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		t.Fatalf("netip.ParsePrefix(%q) error = %v", cidr, err)
+	}
+	return prefix
+}
+
+func TestIsTrustedProxy(t *testing.T) {
+	m := &Middleware{
+		trustedProxyNets: []netip.Prefix{
+			mustPrefix(t, "10.0.0.0/8"),
+			mustPrefix(t, "2001:db8::/32"),
+		},
+	}
+
+	tests := []struct {
+		name string
+		ip   string
+		want bool
+	}{
+		{name: "in trusted IPv4 range", ip: "10.1.2.3", want: true},
+		{name: "outside trusted IPv4 range", ip: "192.168.1.1", want: false},
+		{name: "in trusted IPv6 range", ip: "2001:db8::1", want: true},
+		{name: "outside trusted IPv6 range", ip: "2001:db9::1", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip := netip.MustParseAddr(tt.ip)
+			if got := m.isTrustedProxy(ip); got != tt.want {
+				t.Errorf("isTrustedProxy(%s) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractClientIPFromXFF(t *testing.T) {
+	tests := []struct {
+		name     string
+		xffDepth int
+		trusted  []netip.Prefix
+		header   string
+		remote   string
+		want     string
+	}{
+		{
+			name:     "no trusted proxies, depth 1 picks rightmost",
+			xffDepth: 1,
+			header:   "203.0.113.1, 198.51.100.2",
+			remote:   "127.0.0.1:1234",
+			want:     "198.51.100.2",
+		},
+		{
+			name:     "skips a trusted proxy hop",
+			xffDepth: 1,
+			trusted:  []netip.Prefix{mustPrefix(t, "10.0.0.0/8")},
+			header:   "203.0.113.1, 10.0.0.5",
+			remote:   "127.0.0.1:1234",
+			want:     "203.0.113.1",
+		},
+		{
+			name:     "depth 2 skips one untrusted hop too",
+			xffDepth: 2,
+			header:   "203.0.113.1, 198.51.100.2, 198.51.100.3",
+			remote:   "127.0.0.1:1234",
+			want:     "198.51.100.2",
+		},
+		{
+			name:     "malformed entries are skipped",
+			xffDepth: 1,
+			header:   "not-an-ip, 198.51.100.2",
+			remote:   "127.0.0.1:1234",
+			want:     "198.51.100.2",
+		},
+		{
+			name:     "depth exceeds available untrusted hops falls back to leftmost",
+			xffDepth: 5,
+			header:   "203.0.113.1, 198.51.100.2",
+			remote:   "127.0.0.1:1234",
+			want:     "203.0.113.1",
+		},
+		{
+			name:     "empty header falls back to remote addr",
+			xffDepth: 1,
+			header:   "",
+			remote:   "192.0.2.9:1234",
+			want:     "192.0.2.9",
+		},
+		{
+			name:     "only malformed entries falls back to remote addr",
+			xffDepth: 1,
+			header:   "not-an-ip, also-not-an-ip",
+			remote:   "192.0.2.9:1234",
+			want:     "192.0.2.9",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &Middleware{XFFDepth: tt.xffDepth, trustedProxyNets: tt.trusted}
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remote
+			if tt.header != "" {
+				req.Header.Set("X-Forwarded-For", tt.header)
+			}
+
+			got, err := m.extractClientIPFromXFF(req)
+			if err != nil {
+				t.Fatalf("extractClientIPFromXFF() error = %v", err)
+			}
+			if got.String() != tt.want {
+				t.Errorf("extractClientIPFromXFF() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractClientIP(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy ClientIPStrategy
+		header   string
+		remote   string
+		want     string
+	}{
+		{
+			name:     "remote_addr strategy uses RemoteAddr",
+			strategy: ClientIPStrategyRemoteAddr,
+			remote:   "192.0.2.9:1234",
+			want:     "192.0.2.9",
+		},
+		{
+			name:     "xff strategy reads X-Forwarded-For",
+			strategy: ClientIPStrategyXFF,
+			header:   "203.0.113.1",
+			remote:   "127.0.0.1:1234",
+			want:     "203.0.113.1",
+		},
+		{
+			name:     "cf_connecting_ip strategy reads Cf-Connecting-Ip",
+			strategy: ClientIPStrategyCFConnectingIP,
+			remote:   "127.0.0.1:1234",
+			want:     "198.51.100.7",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &Middleware{ClientIPStrategy: tt.strategy, XFFDepth: 1}
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remote
+			if tt.header != "" {
+				req.Header.Set("X-Forwarded-For", tt.header)
+			}
+			if tt.strategy == ClientIPStrategyCFConnectingIP {
+				req.Header.Set("Cf-Connecting-Ip", tt.want)
+			}
+
+			got, err := m.extractClientIP(req)
+			if err != nil {
+				t.Fatalf("extractClientIP() error = %v", err)
+			}
+			if got.String() != tt.want {
+				t.Errorf("extractClientIP() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}